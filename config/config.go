@@ -8,15 +8,25 @@ import (
 
 // EdgeConfig represents the runtime configuration
 type EdgeConfig struct {
-	Hostname    string
-	Auth        bool
-	WebPort     int
-	MetricsPort int
-	Logging     *loggingConfig
-	LogLevel    string
-	Debug       bool
-	Database    *dbConfig
-	BucketName  string
+	Hostname         string
+	Auth             bool
+	WebPort          int
+	MetricsPort      int
+	Logging          *loggingConfig
+	LogLevel         string
+	Debug            bool
+	Database         *dbConfig
+	BucketName       string
+	TarballsCacheDir string
+	Signing          *signingConfig
+	ObjectCachePath  string
+}
+
+type signingConfig struct {
+	GPGKeyID         string
+	GPGKeyringPath   string
+	PassphraseSource string // "" (unencrypted keyring), "kms", or "vault"
+	PassphraseKeyRef string // KMS key ARN or Vault secret path, depending on PassphraseSource
 }
 
 type dbConfig struct {
@@ -27,7 +37,6 @@ type dbConfig struct {
 	Name     string
 }
 
-//
 type loggingConfig struct {
 	AccessKeyId     string
 	SecretAccessKey string
@@ -46,19 +55,30 @@ func Init() {
 	options.SetDefault("Auth", true)
 	options.SetDefault("Debug", false)
 	options.SetDefault("EdgeTarballsBucket", "rh-edge-tarballs")
+	options.SetDefault("TarballsCacheDir", "/var/tmp/edge-api/cache")
+	options.SetDefault("GpgKeyringPath", "/etc/edge-api/gpg")
+	options.SetDefault("ObjectCachePath", "/var/lib/edge-api/cache-repo")
 	options.AutomaticEnv()
 
 	kubenv := viper.New()
 	kubenv.AutomaticEnv()
 
 	config = &EdgeConfig{
-		Hostname:    kubenv.GetString("Hostname"),
-		Auth:        options.GetBool("Auth"),
-		WebPort:     options.GetInt("WebPort"),
-		MetricsPort: options.GetInt("MetricsPort"),
-		Debug:       options.GetBool("Debug"),
-		LogLevel:    options.GetString("LogLevel"),
-		BucketName:  options.GetString("EdgeTarballsBucket"),
+		Hostname:         kubenv.GetString("Hostname"),
+		Auth:             options.GetBool("Auth"),
+		WebPort:          options.GetInt("WebPort"),
+		MetricsPort:      options.GetInt("MetricsPort"),
+		Debug:            options.GetBool("Debug"),
+		LogLevel:         options.GetString("LogLevel"),
+		BucketName:       options.GetString("EdgeTarballsBucket"),
+		TarballsCacheDir: options.GetString("TarballsCacheDir"),
+		Signing: &signingConfig{
+			GPGKeyID:         options.GetString("GpgKeyId"),
+			GPGKeyringPath:   options.GetString("GpgKeyringPath"),
+			PassphraseSource: options.GetString("GpgPassphraseSource"),
+			PassphraseKeyRef: options.GetString("GpgPassphraseKeyRef"),
+		},
+		ObjectCachePath: options.GetString("ObjectCachePath"),
 	}
 
 	if clowder.IsClowderEnabled() {
@@ -0,0 +1,298 @@
+// Package download provides a pluggable, retryable replacement for the
+// single grab.Get call RepoBuilder used to use to fetch commit tarballs.
+// A Downloader is selected by URL scheme (https, s3, file) and wrapped by a
+// Puller that adds retry, checksum verification, and an on-disk cache so
+// repeated builds don't re-fetch the same commit.
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Downloader fetches the object at src and writes it to dest
+type Downloader interface {
+	Download(ctx context.Context, src string, dest io.Writer) error
+}
+
+// NewDownloader selects a Downloader implementation based on the URL scheme
+// of src: https:// uses plain HTTP, s3:// builds an AWS session the same
+// way repo.S3Proxy builds its own (so the same IAM/clowder credentials are
+// picked up), and file:// (or no scheme) reads from the local filesystem.
+func NewDownloader(src string) (Downloader, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "https", "http":
+		return &HTTPDownloader{Client: http.DefaultClient}, nil
+	case "s3":
+		sess := session.Must(session.NewSession())
+		// One part at a time: fakeWriterAt ignores offsets, so parts must
+		// arrive in order.
+		dl := s3manager.NewDownloader(sess, func(d *s3manager.Downloader) { d.Concurrency = 1 })
+		return &S3Downloader{Downloader: dl, Client: s3.New(sess)}, nil
+	case "file", "":
+		return &FileDownloader{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported download scheme %q", u.Scheme)
+	}
+}
+
+// HTTPDownloader fetches tarballs over plain HTTP(S)
+type HTTPDownloader struct {
+	Client *http.Client
+}
+
+func (d *HTTPDownloader) Download(ctx context.Context, src string, dest io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: unexpected status %d", src, resp.StatusCode)
+	}
+
+	_, err = io.Copy(dest, resp.Body)
+	return err
+}
+
+// S3Downloader fetches tarballs from s3://bucket/key, using an AWS session
+// built the same way as repo.S3Proxy's so credentials don't need to be
+// configured twice.
+type S3Downloader struct {
+	Downloader *s3manager.Downloader
+	Client     *s3.S3
+}
+
+func (d *S3Downloader) Download(ctx context.Context, src string, dest io.Writer) error {
+	u, err := url.Parse(src)
+	if err != nil {
+		return err
+	}
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+
+	w := &fakeWriterAt{w: dest}
+	_, err = d.Downloader.DownloadWithContext(ctx, w, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// fakeWriterAt adapts an io.Writer to the io.WriterAt the s3manager
+// Downloader requires, since we always download sequentially into a file.
+type fakeWriterAt struct {
+	w io.Writer
+}
+
+func (fw *fakeWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	return fw.w.Write(p)
+}
+
+// FileDownloader reads tarballs from the local filesystem, for file:// URLs
+// or bare paths
+type FileDownloader struct{}
+
+func (d *FileDownloader) Download(ctx context.Context, src string, dest io.Writer) error {
+	path := src
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		path = u.Path
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dest, f)
+	return err
+}
+
+// RetryConfig controls the Puller's exponential-backoff retry behaviour
+type RetryConfig struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryConfig is what RepoBuilder uses: a handful of
+// attempts with modest backoff, enough to ride out a transient 5xx without
+// stalling a build indefinitely.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// Puller wraps a Downloader with retry, per-object locking, checksum
+// verification, and an on-disk cache keyed by the expected hash so two
+// concurrent updates referencing the same commit don't double-fetch.
+type Puller struct {
+	Retry    RetryConfig
+	CacheDir string
+	keyLocks sync.Map // map[string]*sync.Mutex
+}
+
+// NewPuller creates a Puller that caches verified tarballs under cacheDir
+func NewPuller(cacheDir string, retry RetryConfig) *Puller {
+	return &Puller{Retry: retry, CacheDir: cacheDir}
+}
+
+func (p *Puller) lockFor(key string) *sync.Mutex {
+	l, _ := p.keyLocks.LoadOrStore(key, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// Pull fetches src, verifies it against expectedSHA256, and writes the
+// result to destPath. If a verified copy already exists in the cache it is
+// copied into place and the download is skipped entirely.
+func (p *Puller) Pull(ctx context.Context, src string, expectedSHA256 string, destPath string) error {
+	lock := p.lockFor(expectedSHA256)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cachePath := p.cachePath(expectedSHA256)
+	if cachePath != "" {
+		if _, err := os.Stat(cachePath); err == nil {
+			return copyFile(cachePath, destPath)
+		}
+	}
+
+	downloader, err := NewDownloader(src)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := destPath + ".partial"
+	if err := p.fetchWithRetry(ctx, downloader, src, tmpPath); err != nil {
+		return err
+	}
+
+	sum, err := sha256File(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if expectedSHA256 != "" && sum != expectedSHA256 {
+		os.Remove(tmpPath)
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", src, expectedSHA256, sum)
+	}
+
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return err
+	}
+
+	if cachePath != "" {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			copyFile(destPath, cachePath)
+		}
+	}
+
+	return nil
+}
+
+func (p *Puller) fetchWithRetry(ctx context.Context, downloader Downloader, src string, destPath string) error {
+	var lastErr error
+	for attempt := 0; attempt < p.Retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := p.backoff(attempt)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		lastErr = p.fetchOnce(ctx, downloader, src, destPath)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("download %s failed after %d attempts: %w", src, p.Retry.MaxAttempts, lastErr)
+}
+
+func (p *Puller) fetchOnce(ctx context.Context, downloader Downloader, src string, destPath string) error {
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return downloader.Download(ctx, src, f)
+}
+
+// backoff returns an exponential delay for the given attempt with jitter,
+// capped at MaxDelay
+func (p *Puller) backoff(attempt int) time.Duration {
+	delay := p.Retry.BaseDelay * time.Duration(1<<uint(attempt-1))
+	if delay > p.Retry.MaxDelay {
+		delay = p.Retry.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+func (p *Puller) cachePath(sha string) string {
+	if p.CacheDir == "" || sha == "" {
+		return ""
+	}
+	return filepath.Join(p.CacheDir, sha)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
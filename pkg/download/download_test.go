@@ -0,0 +1,114 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryConfig() RetryConfig {
+	return RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+}
+
+func sha256Hex(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPullRetriesOnServerError(t *testing.T) {
+	const body = "tarball contents"
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := NewPuller(t.TempDir(), testRetryConfig())
+	dest := filepath.Join(t.TempDir(), "out.tar")
+
+	if err := p.Pull(context.Background(), srv.URL, sha256Hex(body), dest); err != nil {
+		t.Fatalf("Pull failed after retries: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Fatalf("expected 3 requests (2 failures + 1 success), got %d", got)
+	}
+
+	contents, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("reading downloaded file: %v", err)
+	}
+	if string(contents) != body {
+		t.Fatalf("downloaded contents = %q, want %q", contents, body)
+	}
+}
+
+func TestPullRejectsChecksumMismatch(t *testing.T) {
+	const body = "tarball contents"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := NewPuller(t.TempDir(), testRetryConfig())
+	dest := filepath.Join(t.TempDir(), "out.tar")
+
+	err := p.Pull(context.Background(), srv.URL, "0000000000000000000000000000000000000000000000000000000000000", dest)
+	if err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+
+	if _, statErr := os.Stat(dest); !os.IsNotExist(statErr) {
+		t.Fatalf("expected %s not to exist after a checksum mismatch, stat err = %v", dest, statErr)
+	}
+}
+
+func TestPullCacheHitSkipsDownload(t *testing.T) {
+	const body = "tarball contents"
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	p := NewPuller(t.TempDir(), testRetryConfig())
+	sum := sha256Hex(body)
+
+	first := filepath.Join(t.TempDir(), "first.tar")
+	if err := p.Pull(context.Background(), srv.URL, sum, first); err != nil {
+		t.Fatalf("first Pull failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected 1 request after first Pull, got %d", got)
+	}
+
+	second := filepath.Join(t.TempDir(), "second.tar")
+	if err := p.Pull(context.Background(), srv.URL, sum, second); err != nil {
+		t.Fatalf("second Pull failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected cache hit to skip the download, but server saw %d requests", got)
+	}
+
+	contents, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatalf("reading cached file: %v", err)
+	}
+	if string(contents) != body {
+		t.Fatalf("cached contents = %q, want %q", contents, body)
+	}
+}
@@ -0,0 +1,134 @@
+// Package events provides a small fan-out bus so HTTP clients can watch
+// state transitions (operation progress, log lines) live over SSE instead
+// of polling UpdateRecord.State.
+package events
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/edge-api/pkg/common"
+)
+
+// Type identifies the kind of event a subscriber is interested in
+type Type string
+
+const (
+	TypeOperation Type = "operation"
+	TypeLog       Type = "log"
+)
+
+// Event is a single message published on the bus
+type Event struct {
+	Type      Type
+	Account   string
+	ID        uint
+	Message   string
+	Timestamp time.Time
+}
+
+type subscriber struct {
+	types   []Type
+	account string
+	ch      chan Event
+}
+
+var (
+	mu   sync.Mutex
+	subs = make(map[*subscriber]struct{})
+)
+
+// Publish fans an event out to every subscriber interested in typ that
+// belongs to account. It never blocks: a slow or disconnected subscriber
+// drops events rather than stalling the publisher.
+func Publish(typ Type, account string, id uint, message string) {
+	ev := Event{Type: typ, Account: account, ID: id, Message: message, Timestamp: time.Now()}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for sub := range subs {
+		if sub.account != account || !wants(sub, typ) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+func wants(sub *subscriber, typ Type) bool {
+	for _, t := range sub.types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func subscribe(types []Type, account string) *subscriber {
+	sub := &subscriber{types: types, account: account, ch: make(chan Event, 64)}
+	mu.Lock()
+	subs[sub] = struct{}{}
+	mu.Unlock()
+	return sub
+}
+
+func unsubscribe(sub *subscriber) {
+	mu.Lock()
+	delete(subs, sub)
+	mu.Unlock()
+	close(sub.ch)
+}
+
+// Stream serves GET /events?type=operation,log as a Server-Sent Events
+// stream scoped to the caller's account, pushing events of the requested
+// types as they're published.
+func Stream(w http.ResponseWriter, r *http.Request) {
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	types := parseTypes(r.URL.Query().Get("type"))
+	sub := subscribe(types, account)
+	defer unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-sub.ch:
+			fmt.Fprintf(w, "event: %s\ndata: {\"ID\":%d,\"Message\":%q,\"Timestamp\":%q}\n\n",
+				ev.Type, ev.ID, ev.Message, ev.Timestamp.Format(time.RFC3339Nano))
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func parseTypes(raw string) []Type {
+	if raw == "" {
+		return []Type{TypeOperation, TypeLog}
+	}
+	var types []Type
+	for _, t := range strings.Split(raw, ",") {
+		types = append(types, Type(strings.TrimSpace(t)))
+	}
+	return types
+}
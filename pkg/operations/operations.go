@@ -0,0 +1,299 @@
+// Package operations models long running, cancellable work (currently
+// RepoBuilder invocations) as first-class Operation records, in the same
+// spirit as LXD's split of operations/events into their own package.
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/redhatinsights/edge-api/pkg/common"
+	"github.com/redhatinsights/edge-api/pkg/db"
+	"github.com/redhatinsights/edge-api/pkg/events"
+	"gorm.io/gorm"
+)
+
+// State is one of the states in the Operation state machine
+type State string
+
+const (
+	Pending   State = "PENDING"
+	Running   State = "RUNNING"
+	Success   State = "SUCCESS"
+	Failure   State = "FAILURE"
+	Cancelled State = "CANCELLED"
+)
+
+// Resources records the database records an Operation touches, so a client
+// can correlate an Operation back to the UpdateRecord and commits it acts on
+type Resources struct {
+	UpdateID uint     `json:"UpdateID,omitempty"`
+	Commits  []string `json:"Commits,omitempty"`
+}
+
+// Operation tracks the progress and outcome of a single RepoBuilder
+// invocation
+type Operation struct {
+	gorm.Model
+	Account   string
+	State     State
+	Progress  int
+	Error     string
+	Resources Resources `gorm:"embedded"`
+	StartedAt *time.Time
+	EndedAt   *time.Time
+}
+
+// live holds the pieces of a running Operation that can't be stored in the
+// database: the cancel func that tears down its context, and the channel
+// closed when it finishes so Wait can block on it.
+type live struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	mu      sync.Mutex
+	tracked = make(map[uint]*live)
+)
+
+// New creates a Pending Operation owned by account for the given resources
+// and persists it. It returns the Operation along with a context that
+// should be passed down to the work (e.g. os/exec ostree calls) so Cancel
+// can interrupt it.
+func New(parent context.Context, account string, res Resources) (*Operation, context.Context) {
+	op := &Operation{
+		Account:   account,
+		State:     Pending,
+		Resources: res,
+	}
+	db.DB.Create(op)
+
+	ctx, cancel := context.WithCancel(parent)
+	mu.Lock()
+	tracked[op.ID] = &live{cancel: cancel, done: make(chan struct{})}
+	mu.Unlock()
+
+	return op, ctx
+}
+
+// Start transitions an Operation to RUNNING and records the start time
+func Start(op *Operation) {
+	now := time.Now()
+	op.State = Running
+	op.StartedAt = &now
+	db.DB.Save(op)
+	events.Publish(events.TypeOperation, op.Account, op.ID, string(op.State))
+}
+
+// SetProgress updates the completion percentage of a running Operation and
+// publishes the delta so SSE clients watching the build see it live
+func SetProgress(op *Operation, percent int) {
+	op.Progress = percent
+	db.DB.Save(op)
+	events.Publish(events.TypeOperation, op.Account, op.ID, fmt.Sprintf("progress=%d", percent))
+}
+
+// Finish transitions an Operation to its terminal state. Pass a nil err for
+// SUCCESS; any non-nil err moves the Operation to FAILURE and records its
+// message — unless Cancel already moved it to CANCELLED, in which case that
+// takes precedence: the worker's own ctx.Err()/exec failure coming back
+// through err is just the cancellation propagating, not a new failure, and
+// must not stomp the CANCELLED state back to FAILURE.
+func Finish(op *Operation, err error) {
+	now := time.Now()
+	op.EndedAt = &now
+
+	var current Operation
+	cancelled := db.DB.First(&current, op.ID).Error == nil && current.State == Cancelled
+
+	switch {
+	case cancelled:
+		op.State = Cancelled
+	case err != nil:
+		op.State = Failure
+		op.Error = err.Error()
+	default:
+		op.State = Success
+		op.Progress = 100
+	}
+
+	db.DB.Save(op)
+	events.Publish(events.TypeOperation, op.Account, op.ID, string(op.State))
+
+	mu.Lock()
+	if l, ok := tracked[op.ID]; ok {
+		close(l.done)
+		delete(tracked, op.ID)
+	}
+	mu.Unlock()
+}
+
+// Cancel requests that a PENDING or RUNNING Operation owned by account
+// stop. The Operation's context is cancelled so any os/exec ostree command
+// running on its behalf receives SIGKILL via CommandContext. The Operation
+// is marked CANCELLED here, before the context is cancelled, and Finish
+// keeps it CANCELLED when the worker returns.
+func Cancel(account string, id uint) error {
+	var op Operation
+	if result := db.DB.Where("account = ?", account).First(&op, id); result.Error != nil {
+		return result.Error
+	}
+
+	mu.Lock()
+	l, ok := tracked[id]
+	mu.Unlock()
+	if !ok {
+		return fmt.Errorf("operation %d is not running", id)
+	}
+
+	op.State = Cancelled
+	db.DB.Save(&op)
+	events.Publish(events.TypeOperation, op.Account, op.ID, string(op.State))
+
+	l.cancel()
+	return nil
+}
+
+// Wait blocks until the Operation owned by account reaches a terminal
+// state or timeout elapses, whichever comes first, and returns the final
+// Operation record
+func Wait(account string, id uint, timeout time.Duration) (*Operation, error) {
+	var op Operation
+	if result := db.DB.Where("account = ?", account).First(&op, id); result.Error != nil {
+		return nil, result.Error
+	}
+
+	mu.Lock()
+	l, ok := tracked[id]
+	mu.Unlock()
+
+	if ok {
+		select {
+		case <-l.done:
+		case <-time.After(timeout):
+		}
+	}
+
+	if result := db.DB.First(&op, id); result.Error != nil {
+		return nil, result.Error
+	}
+	return &op, nil
+}
+
+// MakeRouter adds support for listing, inspecting, cancelling, and waiting
+// on operations
+func MakeRouter(sub chi.Router) {
+	sub.Get("/", GetAll)
+	sub.Route("/{operationID}", func(r chi.Router) {
+		r.Get("/", GetByID)
+		r.Delete("/", CancelByID)
+		r.Get("/wait", WaitByID)
+	})
+}
+
+func getID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "operationID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// GetAll returns every Operation owned by the caller's account
+func GetAll(w http.ResponseWriter, r *http.Request) {
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ops []Operation
+	result := db.DB.Where("account = ?", account).Find(&ops)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(&ops)
+}
+
+// GetByID returns a single Operation owned by the caller's account
+func GetByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := getID(w, r)
+	if !ok {
+		return
+	}
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var op Operation
+	result := db.DB.Where("account = ?", account).First(&op, id)
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(&op)
+}
+
+// CancelByID cancels a PENDING or RUNNING Operation owned by the caller's
+// account
+func CancelByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := getID(w, r)
+	if !ok {
+		return
+	}
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := Cancel(account, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// WaitByID blocks until an Operation owned by the caller's account
+// finishes or the timeout query param (a Go duration string, default 30s)
+// elapses
+func WaitByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := getID(w, r)
+	if !ok {
+		return
+	}
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	op, err := Wait(account, id, timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(op)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -15,10 +16,26 @@ import (
 	"github.com/redhatinsights/edge-api/pkg/common"
 )
 
+// VersionHeader lets a client pin ServeRepo to a prior repo generation
+// without changing the URL, as an alternative to the ?version= query param
+const VersionHeader = "X-Edge-Repo-Version"
+
 type Server interface {
 	ServeRepo(w http.ResponseWriter, r *http.Request)
 }
 
+// Uploader publishes a built repo to its backing storage and reports back
+// the identifier (an S3 VersionId, or a local versions/<id> directory name)
+// that a RepoVersion row can be keyed on for later rollback
+type Uploader interface {
+	Upload(src string, account string, updateID uint) (string, error)
+
+	// Republish re-copies a previously published generation's objects onto
+	// account's live (unversioned) keys/path, so the stable URL an ostree
+	// client is configured against serves that generation again.
+	Republish(account string, generation string) error
+}
+
 func getNameAndPrefix(r *http.Request) (string, string, error) {
 	name := chi.URLParam(r, "name")
 	if name == "" {
@@ -29,6 +46,19 @@ func getNameAndPrefix(r *http.Request) (string, string, error) {
 	return name, pathPrefix, nil
 }
 
+// requestedVersion returns the repo version the client asked for, either via
+// the ?version= query param or the X-Edge-Repo-Version header, and whether
+// one was given at all.
+func requestedVersion(r *http.Request) (string, bool) {
+	if v := r.URL.Query().Get("version"); v != "" {
+		return v, true
+	}
+	if v := r.Header.Get(VersionHeader); v != "" {
+		return v, true
+	}
+	return "", false
+}
+
 type FileServer struct {
 	BasePath string
 }
@@ -40,30 +70,111 @@ func (s *FileServer) ServeRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	path := filepath.Join(s.BasePath, name)
+	if version, ok := requestedVersion(r); ok {
+		path = filepath.Join(s.BasePath, "versions", version, name)
+	}
 	fs := http.StripPrefix(pathPrefix, http.FileServer(http.Dir(path)))
 	fs.ServeHTTP(w, r)
 }
 
+// FileUploader publishes a built repo under BasePath for the non-clowder dev
+// path, mirroring each publish under versions/<updateID>/ so ServeRepo can
+// serve a prior generation the same way S3Uploader does with VersionId.
+type FileUploader struct {
+	BasePath string
+}
+
+func (u *FileUploader) Upload(src string, account string, updateID uint) (string, error) {
+	dest := filepath.Join(u.BasePath, account)
+	if err := copyTree(src, dest); err != nil {
+		return "", err
+	}
+
+	version := fmt.Sprint(updateID)
+	versionDest := filepath.Join(u.BasePath, "versions", version, account)
+	if err := copyTree(src, versionDest); err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+// Republish re-copies a previously published generation back over the live
+// account/ tree, so FileServer.ServeRepo (which only consults
+// versions/<generation>/ when a version is explicitly requested) serves it
+// by default again.
+func (u *FileUploader) Republish(account string, generation string) error {
+	versionDest := filepath.Join(u.BasePath, "versions", generation, account)
+	dest := filepath.Join(u.BasePath, account)
+	return copyTree(versionDest, dest)
+}
+
+func copyTree(src string, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, os.FileMode(0755))
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		if err := os.MkdirAll(filepath.Dir(target), os.FileMode(0755)); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
+
 type S3Proxy struct {
-	Client *s3.S3
-	Bucket string
+	Client     *s3.S3
+	Bucket     string
+	Versioning bool
 }
 
 func NewS3Proxy() *S3Proxy {
 	cfg := config.Get()
 	sess := session.Must(session.NewSession())
 	client := s3.New(sess)
-	return &S3Proxy{
+	proxy := &S3Proxy{
 		Client: client,
 		Bucket: cfg.BucketName,
 	}
+
+	if _, err := client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(cfg.BucketName)}); err == nil {
+		if out, err := client.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(cfg.BucketName)}); err == nil {
+			proxy.Versioning = out.Status != nil && *out.Status == s3.BucketVersioningStatusEnabled
+		}
+	}
+
+	return proxy
 }
 
 // ServeRepo proxies requests to a backing object storage bucket
 // The request is modified from:
-//  path/to/api/$name/path/in/repo
+//
+//	path/to/api/$name/path/in/repo
+//
 // to:
-//  bucket/$account/$name/path/in/repo
+//
+//	bucket/$account/path/in/repo
 func (p *S3Proxy) ServeRepo(w http.ResponseWriter, r *http.Request) {
 
 	_, pathPrefix, err := getNameAndPrefix(r)
@@ -81,10 +192,20 @@ func (p *S3Proxy) ServeRepo(w http.ResponseWriter, r *http.Request) {
 	_r := strings.Index(r.URL.Path, pathPrefix)
 	realPath := filepath.Join(account, string(r.URL.Path[_r+len(pathPrefix):]))
 
-	o, err := p.Client.GetObject(&s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(p.Bucket),
 		Key:    aws.String(realPath),
-	})
+	}
+	if generation, ok := requestedVersion(r); ok && p.Versioning {
+		versionID, err := ResolveObjectVersionID(generation, realPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		input.VersionId = aws.String(versionID)
+	}
+
+	o, err := p.Client.GetObject(input)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -97,3 +218,89 @@ func (p *S3Proxy) ServeRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// S3Uploader publishes a built repo to the shared edge tarballs bucket and
+// records the VersionId S3 hands back for each uploaded object, so prior
+// generations stay addressable even after the unversioned key is overwritten
+// by a later build.
+type S3Uploader struct {
+	Client *s3.S3
+	Bucket string
+}
+
+func NewS3Uploader() *S3Uploader {
+	cfg := config.Get()
+	sess := session.Must(session.NewSession())
+	return &S3Uploader{
+		Client: s3.New(sess),
+		Bucket: cfg.BucketName,
+	}
+}
+
+// Upload puts every file under src to the bucket under account/, and
+// records the per-key VersionId S3 hands back for each one against a
+// single generation label (the updateID, matching FileUploader's
+// versions/<updateID>/ convention) so ServeRepo can resolve any key within
+// this generation back to its own VersionId later.
+func (u *S3Uploader) Upload(src string, account string, updateID uint) (string, error) {
+	generation := fmt.Sprint(updateID)
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.Join(account, rel)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		out, err := u.Client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(u.Bucket),
+			Key:    aws.String(key),
+			Body:   f,
+		})
+		if err != nil {
+			return err
+		}
+		if out.VersionId == nil {
+			return nil
+		}
+		return RecordObjectVersion(updateID, generation, key, *out.VersionId)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return generation, nil
+}
+
+// Republish copies every object recorded for generation back onto its own
+// live (unversioned) key, using S3's CopySource VersionId syntax, so the
+// stable URL an ostree client is configured against serves that generation
+// again without the client ever passing ?version=.
+func (u *S3Uploader) Republish(account string, generation string) error {
+	objects, err := ObjectVersionsForGeneration(generation)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		copySource := fmt.Sprintf("%s/%s?versionId=%s", u.Bucket, obj.Key, obj.VersionID)
+		_, err := u.Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(u.Bucket),
+			Key:        aws.String(obj.Key),
+			CopySource: aws.String(copySource),
+		})
+		if err != nil {
+			return fmt.Errorf("republish %s@%s: %w", obj.Key, obj.VersionID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/redhatinsights/edge-api/pkg/db"
+	"gorm.io/gorm"
+)
+
+// RepoVersion records the storage-level identifier of one repo generation
+// published for an account, so a client can list prior generations or roll
+// one back without having to reach into S3 directly. It's keyed by Account
+// rather than UpdateID: an account's stable repo URL is a long-lived
+// resource that many builds publish to over time, while an UpdateID is a
+// one-shot build record, so UpdateID alone can't be rolled back *to* once
+// its build has finished.
+type RepoVersion struct {
+	gorm.Model
+	Account   string
+	UpdateID  uint
+	VersionID string
+	Current   bool
+}
+
+// RecordVersion persists the VersionId an Uploader returned for a build of
+// account's repo, marking it as the current pointer and demoting every
+// other recorded version for that account.
+func RecordVersion(account string, updateID uint, versionID string) (*RepoVersion, error) {
+	if result := db.DB.Model(&RepoVersion{}).Where("account = ?", account).Update("current", false); result.Error != nil {
+		return nil, result.Error
+	}
+
+	rv := &RepoVersion{Account: account, UpdateID: updateID, VersionID: versionID, Current: true}
+	if result := db.DB.Create(rv); result.Error != nil {
+		return nil, result.Error
+	}
+	return rv, nil
+}
+
+// ListVersions returns every recorded RepoVersion for an account, most
+// recent first
+func ListVersions(account string) ([]RepoVersion, error) {
+	var versions []RepoVersion
+	result := db.DB.Where("account = ?", account).Order("id desc").Find(&versions)
+	return versions, result.Error
+}
+
+// RepoObjectVersion records the S3 VersionId of a single uploaded object
+// within a repo generation. A generation (the value stored in
+// RepoVersion.VersionID and passed back as ?version=) spans many S3 keys —
+// objects, refs, summary, deltas — and each of those keys gets its own
+// VersionId from S3, so resolving a generation to a single VersionId and
+// reusing it for every key doesn't work; each key needs its own row.
+type RepoObjectVersion struct {
+	gorm.Model
+	UpdateID   uint
+	Generation string
+	Key        string
+	VersionID  string
+}
+
+// RecordObjectVersion persists the S3 VersionId of a single object key
+// uploaded as part of a repo generation
+func RecordObjectVersion(updateID uint, generation string, key string, versionID string) error {
+	return db.DB.Create(&RepoObjectVersion{
+		UpdateID:   updateID,
+		Generation: generation,
+		Key:        key,
+		VersionID:  versionID,
+	}).Error
+}
+
+// ResolveObjectVersionID looks up the S3 VersionId recorded for a single
+// object key within a repo generation, so ServeRepo can resolve each
+// requested key independently instead of reusing one VersionId tree-wide
+func ResolveObjectVersionID(generation string, key string) (string, error) {
+	var rov RepoObjectVersion
+	result := db.DB.Where("generation = ? AND key = ?", generation, key).Order("id desc").First(&rov)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return rov.VersionID, nil
+}
+
+// ObjectVersionsForGeneration returns every recorded object key/VersionID
+// pair uploaded as part of generation, so Republish can copy each one back
+// onto its live (unversioned) key.
+func ObjectVersionsForGeneration(generation string) ([]RepoObjectVersion, error) {
+	var rovs []RepoObjectVersion
+	result := db.DB.Where("generation = ?", generation).Find(&rovs)
+	return rovs, result.Error
+}
+
+// Rollback republishes targetVersionID's objects onto account's live
+// (unversioned) keys/paths via uploader.Republish, so an ostree client
+// hitting the stable URL gets the rolled-back tree immediately, then
+// records the rollback as the new current RepoVersion.
+func Rollback(uploader Uploader, account string, targetVersionID string) (*RepoVersion, error) {
+	var existing RepoVersion
+	if result := db.DB.Where("account = ? AND version_id = ?", account, targetVersionID).First(&existing); result.Error != nil {
+		return nil, fmt.Errorf("version %s not found for account %s: %w", targetVersionID, account, result.Error)
+	}
+
+	if err := uploader.Republish(account, targetVersionID); err != nil {
+		return nil, fmt.Errorf("republish version %s for account %s: %w", targetVersionID, account, err)
+	}
+
+	return RecordVersion(account, existing.UpdateID, targetVersionID)
+}
@@ -0,0 +1,330 @@
+// Package repobuilder assembles an update's repo against a persistent,
+// content-addressed OSTree object cache instead of the old /tmp/update/<id>
+// scratch space, so a commit that shows up in many updates is only ever
+// pulled once and a crashed pod doesn't lose all of its work.
+package repobuilder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redhatinsights/edge-api/config"
+	"github.com/redhatinsights/edge-api/pkg/db"
+	"github.com/redhatinsights/edge-api/pkg/signing"
+	"gorm.io/gorm"
+)
+
+// CommitRef identifies an OSTree commit by the hash osbuild tags it with
+// and the ref it's checked in under
+type CommitRef struct {
+	Hash string
+	Ref  string
+}
+
+// DeltaSpec identifies a static delta between two commits
+type DeltaSpec struct {
+	From string
+	To   string
+}
+
+// StaticDeltas records which static deltas have already been generated for
+// the cache repo, so re-running a build skips work a previous run already
+// did even if the previous run's pod was killed before it could finish.
+type StaticDeltas struct {
+	gorm.Model
+	FromCommit string
+	ToCommit   string
+}
+
+// BuildPlan enumerates exactly what Execute needs to do. ReferencedCommits is
+// every commit the update touches, whether or not it was already in the
+// cache; Execute needs all of them, not just the missing ones, to assemble
+// the view repo, since a commit cached by an earlier update was never
+// pulled into *this* update's view repo before. MissingCommits is the
+// subset RepoBuilder still has to fetch and pull into the cache before
+// Execute runs.
+type BuildPlan struct {
+	UpdateID          uint
+	ViewRepoPath      string
+	ReferencedCommits []CommitRef
+	MissingCommits    []CommitRef
+	MissingDeltas     []DeltaSpec
+}
+
+// Result is what a successful Execute produced
+type Result struct {
+	UpdateID        uint
+	RepoPath        string
+	GeneratedDeltas []DeltaSpec
+}
+
+// cacheRepoPath returns the configured path of the long-lived bare-user
+// cache repo, defaulting to /var/lib/edge-api/cache-repo
+func cacheRepoPath() string {
+	if cfg := config.Get(); cfg != nil && cfg.ObjectCachePath != "" {
+		return cfg.ObjectCachePath
+	}
+	return "/var/lib/edge-api/cache-repo"
+}
+
+// ensureCacheRepo creates the cache repo the first time it's needed
+func ensureCacheRepo(ctx context.Context) (string, error) {
+	path := cacheRepoPath()
+	if _, err := os.Stat(filepath.Join(path, "config")); err == nil {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(path, os.FileMode(0755)); err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "ostree", "--repo", path, "init", "--mode=bare-user")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("init cache repo: %s: %w", string(out), err)
+	}
+	return path, nil
+}
+
+// hasCommit checks whether a commit is already present in the cache repo
+func hasCommit(ctx context.Context, repoPath string, hash string) bool {
+	cmd := exec.CommandContext(ctx, "ostree", "--repo", repoPath, "rev-parse", hash)
+	return cmd.Run() == nil
+}
+
+// hasDelta checks the StaticDeltas table for a previously recorded delta
+func hasDelta(from string, to string) bool {
+	var rec StaticDeltas
+	result := db.DB.Where("from_commit = ? AND to_commit = ?", from, to).First(&rec)
+	return result.Error == nil
+}
+
+// Prepare inspects the cache repo and the StaticDeltas table and returns a
+// BuildPlan enumerating exactly what Execute needs to fetch and generate.
+// viewRepoPath is where the per-update view repo for this build will live.
+func Prepare(ctx context.Context, updateID uint, viewRepoPath string, updateCommit CommitRef, oldCommits []CommitRef) (*BuildPlan, error) {
+	cachePath, err := ensureCacheRepo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	all := append([]CommitRef{updateCommit}, oldCommits...)
+	plan := &BuildPlan{UpdateID: updateID, ViewRepoPath: viewRepoPath, ReferencedCommits: all}
+
+	for _, c := range all {
+		if !hasCommit(ctx, cachePath, c.Hash) {
+			plan.MissingCommits = append(plan.MissingCommits, c)
+		}
+	}
+
+	for _, old := range oldCommits {
+		if !hasDelta(old.Hash, updateCommit.Hash) {
+			plan.MissingDeltas = append(plan.MissingDeltas, DeltaSpec{From: old.Hash, To: updateCommit.Hash})
+		}
+	}
+
+	return plan, nil
+}
+
+// PullIntoCache pulls a commit that lives in a local, freshly-extracted
+// repo (sourceRepo) into the persistent cache repo, keyed by its commit
+// hash so later updates referencing the same commit skip the fetch
+// entirely.
+func PullIntoCache(ctx context.Context, sourceRepo string, commit CommitRef) error {
+	cachePath, err := ensureCacheRepo(ctx)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "ostree", "--repo", cachePath, "pull-local", sourceRepo, commit.Hash)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pull %s into cache: %s: %w", commit.Hash, string(out), err)
+	}
+
+	// pull-local by checksum doesn't create a ref, but GC's prune pass walks
+	// refs to decide what's reachable, so give every cached commit a ref
+	// named after its own hash.
+	refCmd := exec.CommandContext(ctx, "ostree", "--repo", cachePath, "refs", "--create="+commit.Hash, commit.Hash)
+	if out, err := refCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ref %s in cache: %s: %w", commit.Hash, string(out), err)
+	}
+	return nil
+}
+
+// Execute builds the per-update view repo described by plan: it pulls each
+// referenced commit from the cache into the view repo, then generates any
+// static deltas the plan says are still missing. signer signs each newly
+// generated delta the same way RepoBuilder signs commits.
+func Execute(ctx context.Context, signer signing.Signer, plan *BuildPlan) (*Result, error) {
+	cachePath, err := ensureCacheRepo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(plan.ViewRepoPath, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(plan.ViewRepoPath, "config")); err != nil {
+		cmd := exec.CommandContext(ctx, "ostree", "--repo", plan.ViewRepoPath, "init", "--mode=archive")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("init view repo: %s: %w", string(out), err)
+		}
+	}
+
+	// Every referenced commit needs to land in the view repo, not just the
+	// ones that were missing from the cache: a commit cached by an earlier
+	// update's build is already in cachePath but was never pulled into
+	// *this* view repo before. A plain (non-metadata-only) pull-local walks
+	// only the objects reachable from the given commit and hardlinks them
+	// when src and dest share a filesystem, which is exactly the scoped,
+	// cheap copy we want — unlike linking every loose object under the
+	// cache's objects/, whose cost grows with the whole historical cache
+	// rather than with this update.
+	for _, c := range plan.ReferencedCommits {
+		cmd := exec.CommandContext(ctx, "ostree", "--repo", plan.ViewRepoPath, "pull-local", cachePath, c.Hash)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("pull-local %s into view repo: %s: %w", c.Hash, string(out), err)
+		}
+	}
+
+	result := &Result{UpdateID: plan.UpdateID, RepoPath: plan.ViewRepoPath}
+	for _, d := range plan.MissingDeltas {
+		deltaArgs := []string{"--repo", plan.ViewRepoPath, "static-delta", "generate", "--from", d.From, "--to", d.To}
+		deltaArgs = append(deltaArgs, signer.DeltaArgs()...)
+		cmd := exec.CommandContext(ctx, "ostree", deltaArgs...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("generate delta %s..%s: %s: %w", d.From, d.To, string(out), err)
+		}
+
+		deltaPath, err := staticDeltaPath(ctx, plan.ViewRepoPath, d.From, d.To)
+		if err != nil {
+			return nil, err
+		}
+		if err := signer.SignDelta(ctx, deltaPath); err != nil {
+			return nil, err
+		}
+
+		if err := db.DB.Create(&StaticDeltas{FromCommit: d.From, ToCommit: d.To}).Error; err != nil {
+			return nil, err
+		}
+		result.GeneratedDeltas = append(result.GeneratedDeltas, d)
+	}
+
+	return result, nil
+}
+
+// staticDeltaPath locates the on-disk superblock file for the static delta
+// between from and to that was just generated in repoPath. ostree shards a
+// delta's superblock under an internally-derived directory, not the literal
+// "deltas/<from>/<to>" layout its generate/from/to arguments might suggest,
+// so rather than guess that layout we confirm the delta ostree thinks it
+// has via `static-delta list` and then locate the superblock file it just
+// wrote by walking deltas/ for the newest one.
+func staticDeltaPath(ctx context.Context, repoPath string, from string, to string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ostree", "--repo", repoPath, "static-delta", "list")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("list static deltas: %w", err)
+	}
+
+	wantName := to
+	if from != "" {
+		wantName = from + "-" + to
+	}
+	found := false
+	for _, name := range strings.Fields(string(out)) {
+		if name == wantName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("generated delta %s not found in static-delta list", wantName)
+	}
+
+	var newest string
+	var newestMod time.Time
+	err = filepath.Walk(filepath.Join(repoPath, "deltas"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != "superblock" {
+			return err
+		}
+		if info.ModTime().After(newestMod) {
+			newest = path
+			newestMod = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("locate superblock for delta %s: %w", wantName, err)
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no superblock found for delta %s under %s/deltas", wantName, repoPath)
+	}
+	return newest, nil
+}
+
+// GC prunes cache objects not referenced by any commit in keepHashes. The
+// caller supplies that set of commit hashes; repobuilder doesn't know about
+// UpdateRecord itself to keep this package independent of it. Nothing in
+// pkg/updates calls GC or derives the set from UpdateRecords.
+func GC(ctx context.Context, keepHashes []string) error {
+	cachePath, err := ensureCacheRepo(ctx)
+	if err != nil {
+		return err
+	}
+
+	// PullIntoCache gives every cached commit a ref named after its own
+	// hash, so delete each ref not in keepHashes, then let prune
+	// --refs-only sweep the objects no remaining ref reaches.
+	keep := make(map[string]bool, len(keepHashes))
+	for _, h := range keepHashes {
+		keep[h] = true
+	}
+
+	var stale []string
+	cmd := exec.CommandContext(ctx, "ostree", "--repo", cachePath, "refs")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err == nil {
+		for _, ref := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if ref != "" && !keep[ref] {
+				stale = append(stale, ref)
+			}
+		}
+	}
+
+	for _, ref := range stale {
+		deleteCmd := exec.CommandContext(ctx, "ostree", "--repo", cachePath, "refs", "--delete", ref)
+		if out, err := deleteCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("delete stale ref %s: %s: %w", ref, string(out), err)
+		}
+	}
+
+	pruneCmd := exec.CommandContext(ctx, "ostree", "--repo", cachePath, "prune", "--refs-only")
+	if out, err := pruneCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("prune cache repo: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// RunGCPeriodically runs GC on the given interval until ctx is cancelled,
+// calling keepHashes() each time to get the current retention set. It runs
+// until ctx is cancelled, so it belongs in its own goroutine; nothing in
+// this repository starts it.
+func RunGCPeriodically(ctx context.Context, interval time.Duration, keepHashes func() []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			GC(ctx, keepHashes())
+		}
+	}
+}
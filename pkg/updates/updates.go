@@ -1,7 +1,6 @@
 package updates
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -12,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -20,12 +20,30 @@ import (
 	"github.com/redhatinsights/edge-api/pkg/commits"
 	"github.com/redhatinsights/edge-api/pkg/common"
 	"github.com/redhatinsights/edge-api/pkg/db"
+	"github.com/redhatinsights/edge-api/pkg/download"
+	"github.com/redhatinsights/edge-api/pkg/operations"
 	"github.com/redhatinsights/edge-api/pkg/repo"
+	"github.com/redhatinsights/edge-api/pkg/repobuilder"
+	"github.com/redhatinsights/edge-api/pkg/signing"
 	"gorm.io/gorm"
+)
 
-	"github.com/cavaliercoder/grab"
+var (
+	pullerOnce sync.Once
+	pullerInst *download.Puller
 )
 
+// puller returns the package-wide Puller used to fetch commit tarballs,
+// lazily initialized from config so tests and callers don't need to wire it
+// up themselves.
+func puller() *download.Puller {
+	pullerOnce.Do(func() {
+		cfg := config.Get()
+		pullerInst = download.NewPuller(cfg.TarballsCacheDir, download.DefaultRetryConfig)
+	})
+	return pullerInst
+}
+
 // Update reporesents the combination of an OSTree commit and a set of Inventory
 // hosts that need to have the commit deployed to them
 //
@@ -57,6 +75,8 @@ func MakeRouter(sub chi.Router) {
 		r.Use(UpdateCtx)
 		r.Get("/", GetByID)
 		r.Put("/", Update)
+		r.Get("/repo-versions", GetRepoVersions)
+		r.Post("/rollback", Rollback)
 	})
 }
 
@@ -95,9 +115,18 @@ func UpdateCtx(next http.Handler) http.Handler {
 	})
 }
 
-// Add an object to the database for an account
+// Add an object to the database for an account and kick off the RepoBuilder
+// as a cancellable Operation. The caller gets back a 202 Accepted with a
+// Location header pointing at the Operation instead of having to poll
+// UpdateRecord.State.
 func Add(w http.ResponseWriter, r *http.Request) {
 
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	update, err := updateFromReadCloser(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -106,7 +135,28 @@ func Add(w http.ResponseWriter, r *http.Request) {
 
 	db.DB.Create(&update)
 
-	go RepoBuilder(&update, &r)
+	var commitHashes []string
+	for _, c := range update.OldCommits {
+		commitHashes = append(commitHashes, c.OSTreeCommit)
+	}
+	// RepoBuilder keeps running after this handler returns, so its context
+	// must outlive the request: r.Context() is cancelled by net/http the
+	// moment Add returns, which would abort every exec.CommandContext call
+	// almost immediately.
+	op, ctx := operations.New(context.Background(), account, operations.Resources{
+		UpdateID: update.ID,
+		Commits:  commitHashes,
+	})
+
+	go func() {
+		operations.Start(op)
+		err := RepoBuilder(ctx, update, r)
+		operations.Finish(op, err)
+	}()
+
+	w.Header().Set("Location", fmt.Sprintf("/api/edge/v1/operations/%d", op.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&update)
 }
 
 // GetAll update objects from the database for an account
@@ -155,6 +205,64 @@ func Update(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(incoming)
 }
 
+// GetRepoVersions lists the repo generations recorded for the account's
+// repo, most recent first. Versions are keyed by account rather than this
+// particular UpdateID, since the account's repo is the long-lived resource
+// a client's ostree remote points at, while UpdateID only identifies the
+// single build that happened to produce one of its generations.
+func GetRepoVersions(w http.ResponseWriter, r *http.Request) {
+	if update := getUpdate(w, r); update == nil {
+		return
+	}
+
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versions, err := repo.ListVersions(account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(&versions)
+}
+
+// rollbackRequest is the body expected by Rollback
+type rollbackRequest struct {
+	VersionID string
+}
+
+// Rollback republishes an older repo generation onto the account's live
+// (unversioned) repo keys/path, so an ostree client hitting the stable URL
+// gets the rolled-back tree on its very next request, not just when it
+// explicitly asks for ?version=.
+func Rollback(w http.ResponseWriter, r *http.Request) {
+	if update := getUpdate(w, r); update == nil {
+		return
+	}
+
+	account, err := common.GetAccount(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var body rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rv, err := repo.Rollback(selectUploader(""), account, body.VersionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(rv)
+}
+
 func getUpdate(w http.ResponseWriter, r *http.Request) *UpdateRecord {
 	ctx := r.Context()
 	update, ok := ctx.Value(updateKey).(*UpdateRecord)
@@ -165,81 +273,118 @@ func getUpdate(w http.ResponseWriter, r *http.Request) *UpdateRecord {
 	return update
 }
 
-/* RepoBuilder
+/*
+	RepoBuilder
+
 Build an update repo with the set of commits all merged into a single repo
 with static deltas generated between them all
 */
-func RepoBuilder(ur *UpdateRecord, r *http.Request) error {
+func RepoBuilder(ctx context.Context, ur *UpdateRecord, r *http.Request) error {
 	ur.State = "BUILDING"
 	db.DB.Update(&ur)
 
-	path := filepath.Join("/tmp/update/", strconv.FormatUint(uint64(ur.ID), 10))
-	err := os.MkdirAll(path, os.FileMode(int(0755)))
-	if err != nil {
+	signer := signing.NewSigner()
+
+	scratchPath := filepath.Join("/tmp/update/", strconv.FormatUint(uint64(ur.ID), 10))
+	if err := os.MkdirAll(scratchPath, os.FileMode(int(0755))); err != nil {
 		return err
 	}
-	err := os.Chdir(path)
+
+	updateRef := repobuilder.CommitRef{Hash: ur.UpdateCommit.OSTreeCommit, Ref: ur.UpdateCommit.OSTreeRef}
+	var oldRefs []repobuilder.CommitRef
+	byHash := map[string]*commits.Commit{ur.UpdateCommit.OSTreeCommit: ur.UpdateCommit}
+	for _, commit := range ur.OldCommits {
+		oldRefs = append(oldRefs, repobuilder.CommitRef{Hash: commit.OSTreeCommit, Ref: commit.OSTreeRef})
+		byHash[commit.OSTreeCommit] = commit
+	}
+
+	viewRepoPath := filepath.Join(scratchPath, "repo")
+	plan, err := repobuilder.Prepare(ctx, ur.ID, viewRepoPath, updateRef, oldRefs)
 	if err != nil {
 		return err
 	}
-	DownloadExtractVersionRepo(&ur.UpdateCommit, path)
 
-	if len(ur.OldCommits) > 0 {
-		stagePath := filepath.Join(path, "staging")
-		err := os.MkdirAll(stagePath, os.FileMode(int(0755)))
-		if err != nil {
-			return err
+	// Only commits the cache doesn't already have need to be fetched and
+	// extracted; everything else was pulled in by an earlier build.
+	for _, c := range plan.MissingCommits {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		err := os.Chdir(stagePath)
-		if err != nil {
+		commit := byHash[c.Hash]
+		extractPath := filepath.Join(scratchPath, "fetched", c.Hash)
+		if err := DownloadExtractVersionRepo(ctx, signer, commit, extractPath); err != nil {
 			return err
 		}
 
-		// If there are any old commits, we need to download them all to be merged
-		// into the update commit repo
-		//
-		// FIXME: hardcoding "repo" in here because that's how it comes from osbuild
-		for _, commit := range ur.OldCommits {
-			DownloadExtractVersionRepo(&commit, filepath.Join(stagePath, commit.OSTreeCommit))
-			RepoPullLocalStaticDeltas(&ur.UpdateCommit, &commit, filepath.Join(path, "repo"), filepath.Join(stagePath, commit.OSTreeCommit, "repo"))
+		extractedRepo := filepath.Join(extractPath, "repo")
+		if commit.OSTreeCommit != updateRef.Hash {
+			if err := signer.Verify(ctx, extractedRepo, commit.OSTreeRef); err != nil {
+				return fmt.Errorf("refusing to merge unsigned/invalid commit %s: %w", commit.OSTreeCommit, err)
+			}
 		}
 
+		if err := repobuilder.PullIntoCache(ctx, extractedRepo, c); err != nil {
+			return err
+		}
 	}
 
-	err := os.RemoveAll(stagePath)
+	result, err := repobuilder.Execute(ctx, signer, plan)
 	if err != nil {
 		return err
 	}
 
-	cfg := config.Get()
-	var uploader repo.Uploader
-	uploader = &repo.FileUploader{
-		BasePath: path,
+	if err := os.RemoveAll(filepath.Join(scratchPath, "fetched")); err != nil {
+		return err
 	}
-	if cfg.BucketName != "" {
-		uploader = repo.NewS3Uploader()
+
+	if err := signer.PublishPublicKey(ctx, result.RepoPath); err != nil {
+		return err
+	}
+
+	account, err := common.GetAccount(r)
+	if err != nil {
+		return err
+	}
+
+	uploader := selectUploader(scratchPath)
+	versionID, err := uploader.Upload(result.RepoPath, account, ur.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.RecordVersion(account, ur.ID, versionID); err != nil {
+		return err
 	}
-	err := uploader.Upload(filepath.Join(path, "repo"), &r)
 
 	return nil
 }
 
+// selectUploader picks the Uploader RepoBuilder and Rollback publish
+// through: an S3Uploader against the configured bucket when one is set, or
+// a FileUploader rooted at basePath for the non-clowder dev path.
+func selectUploader(basePath string) repo.Uploader {
+	if cfg := config.Get(); cfg.BucketName != "" {
+		return repo.NewS3Uploader()
+	}
+	return &repo.FileUploader{BasePath: basePath}
+}
+
 // DownloadAndExtractRepo
+//
 //	Download and Extract the repo tarball to dest dir
-func DownloadExtractVersionRepo(c *Commit, dest string) error {
+func DownloadExtractVersionRepo(ctx context.Context, signer signing.Signer, c *commits.Commit, dest string) error {
 	// ensure the destination directory exists and then chdir there
 	err := os.MkdirAll(dest, os.FileMode(int(0755)))
 	if err != nil {
 		return err
 	}
-	err := os.Chdir(dest)
+	err = os.Chdir(dest)
 	if err != nil {
 		return err
 	}
 
 	// Save the tarball to the OSBuild Hash ID and then extract it
-	tarFileName := strings.Join([]string{commit.ImageBuildHash, "tar"}, ".")
-	resp, err := grab.Get(filepath.Join(dest, tarFileName), commit.ImageBuildTarURL)
+	tarFileName := strings.Join([]string{c.ImageBuildHash, "tar"}, ".")
+	err = puller().Pull(ctx, c.ImageBuildTarURL, c.ImageBuildHash, filepath.Join(dest, tarFileName))
 	if err != nil {
 		return err
 	}
@@ -251,7 +396,7 @@ func DownloadExtractVersionRepo(c *Commit, dest string) error {
 	common.Untar(tarFile, filepath.Join(dest))
 	tarFile.Close()
 
-	err := os.Remove(filepath.Join(dest, tarFileName))
+	err = os.Remove(filepath.Join(dest, tarFileName))
 	if err != nil {
 		return err
 	}
@@ -260,59 +405,13 @@ func DownloadExtractVersionRepo(c *Commit, dest string) error {
 	//		  osbuild composer but we might want to revisit this later
 	//
 	// commit the version metadata to the current ref
-	cmd := exec.Command("ostree", "--repo", "./repo", "commit", c.OSTreeRef, "--add-metadata-string", fmt.Sprint("version=%s.%s", c.BuildDate, c.BuildNumber))
-	err := cmd.Run()
+	commitArgs := []string{"--repo", "./repo", "commit", c.OSTreeRef, "--add-metadata-string", fmt.Sprint("version=%s.%s", c.BuildDate, c.BuildNumber)}
+	commitArgs = append(commitArgs, signer.CommitArgs()...)
+	cmd := exec.CommandContext(ctx, "ostree", commitArgs...)
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-
-// RepoPullLocalStaticDeltas
-//	Pull local repo into the new update repo and compute static deltas
-//
-//  uprepo should be where the update commit lives, u is the update commit
-//  oldrepo should be where the old commit lives, o is the commit to be merged
-
-func RepoPullLocalStaticDeltas(u *Commit, o *Commit, uprepo string, oldrepo string) error {
-	err := os.Chdir(dest)
-	if err != nil {
-		return err
-	}
-
-	updateRevParse, err := RepoRevParse(uprepo, u.OSTreeRef)
-	oldRevParse, err := RepoRevParse(oldrepo, o.OSTreeRef)
-
-	// pull the local repo at the exact rev (which was HEAD of o.OSTreeRef)
-	cmd := exec.Command("ostree", "--repo", uprepo, "pull-local", oldrepo, oldRevParse)
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	// generate static delta
-	cmd := exec.Command("ostree", "--repo", uprepo, "static-delta", "generate", "--from", oldRevParse, "--to", updateRevParse)
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-	return nil
-
-}
-
-// Handle the RevParse separate since we need the stdout parsed
-func RepoRevParse(path string, ref string) (string, error) {
-	cmd := exec.Command("ostree", "rev-parse", "--repo", path, ref)
-
-	var res bytes.Buffer
-	cmd.Stdout = &res
-
-	err := cmd.Run()
-
-	if err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(res.String()), nil
-}